@@ -19,109 +19,639 @@ limitations under the License.
 package consistenthash
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"hash/crc32"
+	"hash/maphash"
+	"math"
+	"reflect"
+	"sort"
 	"strconv"
-
-	"github.com/bmaxa/trees/rb"
-	"github.com/bmaxa/trees/tree"
+	"sync"
+	"sync/atomic"
 )
 
+// ErrNoCapacity is returned by GetLoad when every node owning the key is
+// already at capacity.
+var ErrNoCapacity = errors.New("consistenthash: no node available under load")
+
+// Hash is a 32-bit hash function. It limits the ring to a 32-bit key space,
+// which causes visible clustering above ~10k virtual nodes; prefer Hash64
+// and New64 for large rings.
 type Hash func(data []byte) uint32
 
-var _ tree.Key = (*node)(nil)
+// Hash64 is a 64-bit hash function, used by New64 and NewSeeded64.
+type Hash64 func(data []byte) uint64
 
-type node struct {
-	hash uint32
-	key  string
+// Placement assigns keys to nodes. RingMap (the default, built by New and
+// friends) and RendezvousMap are the two implementations.
+type Placement interface {
+	// Add registers nodes with the placement.
+	Add(keys ...string)
+	// Remove unregisters a node.
+	Remove(key string)
+	// Get returns the node that owns key.
+	Get(key string) string
+	// GetN returns up to n distinct nodes that own key, in preference order.
+	GetN(key string, n int) []string
 }
 
-func (n *node) Less(than tree.Key) bool {
-	m := than.(*node)
-	if n.hash != m.hash {
-		return n.hash < m.hash
-	}
-	return n.key < m.key
+var _ Placement = (*RingMap)(nil)
+var _ Placement = (*RendezvousMap)(nil)
+
+// ringSnapshot is an immutable view of the ring: hashes is sorted and
+// owners[i] is the node that owns hashes[i]. RingMap swaps in a new snapshot
+// on every Add/Remove so that Get can read it without locking.
+type ringSnapshot struct {
+	hashes []uint64
+	owners []string
 }
 
-func floor(t *tree.Tree, key tree.Key) tree.Iterator {
-	n, tmp := t.Root, (*tree.Node)(nil)
-	for n != nil {
-		if n.Key.Less(key) {
-			n = n.Right
-		} else {
-			tmp = n
-			n = n.Left
-		}
+// floor returns the index of the first hash in the snapshot that is >=
+// hash, wrapping around to 0 if hash is greater than everything on the
+// ring.
+func (s *ringSnapshot) floor(hash uint64) int {
+	idx := sort.Search(len(s.hashes), func(i int) bool { return s.hashes[i] >= hash })
+	if idx == len(s.hashes) {
+		idx = 0
 	}
-	return tree.NewIter(tmp)
+	return idx
 }
 
-type Map struct {
-	hash     Hash
+// ringConfig holds the hash function, replica count and per-node virtual-node
+// hashes for a RingMap. restore (used by UnmarshalBinary/UnmarshalJSON)
+// replaces all of it at once after construction, so it's swapped in
+// atomically - the same pattern as ringSnapshot - letting Get/GetN/GetLoad
+// read m.config.Load().hash without taking m.mu.
+type ringConfig struct {
+	hash     func(data []byte) uint64
+	origHash Hash // the 32-bit Hash passed to New, if any; see MarshalBinary
 	replicas int
-	nodes    *rb.RB
-	keys     map[string][]*node // for removal
+	keys     map[string][]uint64 // per-node virtual-node hashes, for removal
 }
 
-func New(replicas int, fn Hash) *Map {
-	m := &Map{
-		replicas: replicas,
-		hash:     fn,
-		nodes:    rb.New(),
-		keys:     make(map[string][]*node),
+// Map is a backward-compatible alias for RingMap, kept for callers written
+// against the original type name.
+type Map = RingMap
+
+type RingMap struct {
+	config atomic.Pointer[ringConfig]
+
+	mu   sync.Mutex // serializes Add/Remove/restore and rebuilding ring
+	ring atomic.Pointer[ringSnapshot]
+
+	// loadFactor is non-zero when the map was built with NewBounded, in
+	// which case GetLoad's selection is restricted to under-capacity nodes.
+	// On any other map every node's capacity is 0, so GetLoad always
+	// returns ErrNoCapacity.
+	loadFactor float64
+	loads      map[string]int64
+}
+
+func New(replicas int, fn Hash) *RingMap {
+	if fn == nil {
+		fn = crc32.ChecksumIEEE
+	}
+	return newMap(replicas, func(data []byte) uint64 { return uint64(fn(data)) }, fn)
+}
+
+// New64 is like New, but uses a 64-bit hash function, avoiding the
+// clustering a 32-bit hash shows once a ring carries many thousands of
+// virtual nodes. If fn is nil, the ring is hashed with hash/maphash using a
+// seed generated for this RingMap; since maphash seeds are process-local, use
+// NewSeeded64 instead if multiple processes need to agree on the ring.
+func New64(replicas int, fn Hash64) *RingMap {
+	if fn == nil {
+		fn = maphashSum64(maphash.MakeSeed())
 	}
-	if m.hash == nil {
-		m.hash = crc32.ChecksumIEEE
+	return newMap(replicas, fn, nil)
+}
+
+// NewSeeded64 is like New64, but hashes with hash/maphash using the given
+// seed, so that callers in different processes can share the seed and get
+// an identical ring.
+func NewSeeded64(replicas int, seed maphash.Seed) *RingMap {
+	return newMap(replicas, maphashSum64(seed), nil)
+}
+
+// maphashSum64 returns a Hash64 that feeds data into a maphash.Hash seeded
+// with seed and returns its Sum64.
+func maphashSum64(seed maphash.Seed) Hash64 {
+	return func(data []byte) uint64 {
+		var h maphash.Hash
+		h.SetSeed(seed)
+		h.Write(data)
+		return h.Sum64()
 	}
+}
+
+func newMap(replicas int, fn func(data []byte) uint64, origHash Hash) *RingMap {
+	m := &RingMap{}
+	m.config.Store(&ringConfig{
+		hash:     fn,
+		origHash: origHash,
+		replicas: replicas,
+		keys:     make(map[string][]uint64),
+	})
+	m.ring.Store(&ringSnapshot{})
+	return m
+}
+
+// NewBounded is like New, but caps how many in-flight requests any single
+// node may be serving at once. loadFactor must be >= 1.0 (1.25 is a
+// reasonable default); it controls how far a node's load may exceed a
+// perfectly even split before GetLoad starts routing around it. See
+// GetLoad and Done.
+func NewBounded(replicas int, fn Hash, loadFactor float64) *RingMap {
+	m := New(replicas, fn)
+	m.loadFactor = loadFactor
+	m.loads = make(map[string]int64)
 	return m
 }
 
 // Returns true if there are no items available.
-func (m *Map) IsEmpty() bool {
-	return m.nodes.Size() == 0
+func (m *RingMap) IsEmpty() bool {
+	return len(m.ring.Load().hashes) == 0
 }
 
 // Adds some keys to the hash.
-func (m *Map) Add(keys ...string) {
+func (m *RingMap) Add(keys ...string) {
+	weights := make(map[string]int, len(keys))
 	for _, key := range keys {
-		if _, ok := m.keys[key]; ok {
+		weights[key] = 1
+	}
+	m.AddWeightedMany(weights)
+}
+
+// AddWeighted is like Add, but gives key weight*replicas virtual nodes
+// instead of the default replica count, so it claims a proportionally
+// larger (or smaller) share of the ring. A weight of 2 gives key roughly
+// twice the expected load of a weight-1 node; this is how heterogeneous
+// node capacity (e.g. a 2x-larger backend) is expressed without running
+// multiple ring instances. A weight <= 0 is a no-op.
+func (m *RingMap) AddWeighted(key string, weight int) {
+	m.AddWeightedMany(map[string]int{key: weight})
+}
+
+// AddWeightedMany is AddWeighted for several keys at once. Entries with a
+// weight <= 0 are skipped.
+func (m *RingMap) AddWeightedMany(weights map[string]int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cfg := m.config.Load()
+	newKeys := make(map[string][]uint64, len(cfg.keys)+len(weights))
+	for key, hashes := range cfg.keys {
+		newKeys[key] = hashes
+	}
+	changed := false
+	for key, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		if _, ok := newKeys[key]; ok {
 			// Already exists
 			continue
 		}
-		l := make([]*node, m.replicas)
-		for i := 0; i < m.replicas; i++ {
-			hash := m.hash([]byte(strconv.Itoa(i) + key))
-			n := &node{hash: hash, key: key}
-			l[i] = n
-			m.nodes.Insert(tree.Item{
-				Key:   n,
-				Value: nil,
-			})
+		replicas := weight * cfg.replicas
+		hashes := make([]uint64, replicas)
+		for i := 0; i < replicas; i++ {
+			hashes[i] = cfg.hash([]byte(strconv.Itoa(i) + key))
 		}
-		m.keys[key] = l
+		newKeys[key] = hashes
+		if m.loads != nil {
+			m.loads[key] = 0
+		}
+		changed = true
+	}
+	if changed {
+		m.config.Store(&ringConfig{hash: cfg.hash, origHash: cfg.origHash, replicas: cfg.replicas, keys: newKeys})
+		m.rebuildLocked(newKeys)
 	}
 }
 
 // Remove a key from the hash.
-func (m *Map) Remove(key string) {
-	if l, ok := m.keys[key]; ok {
-		for _, n := range l {
-			m.nodes.Delete(n)
+func (m *RingMap) Remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cfg := m.config.Load()
+	if _, ok := cfg.keys[key]; !ok {
+		return
+	}
+	newKeys := make(map[string][]uint64, len(cfg.keys)-1)
+	for k, hashes := range cfg.keys {
+		if k == key {
+			continue
 		}
-		delete(m.keys, key)
+		newKeys[k] = hashes
 	}
+	if m.loads != nil {
+		delete(m.loads, key)
+	}
+	m.config.Store(&ringConfig{hash: cfg.hash, origHash: cfg.origHash, replicas: cfg.replicas, keys: newKeys})
+	m.rebuildLocked(newKeys)
+}
+
+// rebuildLocked recomputes the ring snapshot from keys and atomically swaps
+// it in. m.mu must be held.
+func (m *RingMap) rebuildLocked(keys map[string][]uint64) {
+	total := 0
+	for _, hashes := range keys {
+		total += len(hashes)
+	}
+	type pair struct {
+		hash  uint64
+		owner string
+	}
+	pairs := make([]pair, 0, total)
+	for key, hashes := range keys {
+		for _, h := range hashes {
+			pairs = append(pairs, pair{hash: h, owner: key})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].hash != pairs[j].hash {
+			return pairs[i].hash < pairs[j].hash
+		}
+		return pairs[i].owner < pairs[j].owner
+	})
+
+	snap := &ringSnapshot{
+		hashes: make([]uint64, len(pairs)),
+		owners: make([]string, len(pairs)),
+	}
+	for i, p := range pairs {
+		snap.hashes[i] = p.hash
+		snap.owners[i] = p.owner
+	}
+	m.ring.Store(snap)
 }
 
 // Gets the closest item in the hash to the provided key.
-func (m *Map) Get(key string) string {
-	if m.IsEmpty() {
+func (m *RingMap) Get(key string) string {
+	snap := m.ring.Load()
+	if len(snap.hashes) == 0 {
 		return ""
 	}
-	hash := m.hash([]byte(key))
-	n := node{hash: hash, key: key}
-	iter := floor(&m.nodes.Tree, &n)
-	if iter == m.nodes.End() {
-		iter = m.nodes.Begin()
+	idx := snap.floor(m.config.Load().hash([]byte(key)))
+	return snap.owners[idx]
+}
+
+// GetN returns up to n distinct nodes in ring order starting from key's
+// position, so callers can place a primary plus N-1 replicas, or fail over
+// to the next healthy node. If fewer than n distinct nodes are registered,
+// the returned slice is shorter than n.
+func (m *RingMap) GetN(key string, n int) []string {
+	snap := m.ring.Load()
+	if len(snap.hashes) == 0 || n <= 0 {
+		return nil
+	}
+	idx := snap.floor(m.config.Load().hash([]byte(key)))
+	seen := make(map[string]struct{}, n)
+	result := make([]string, 0, n)
+	for i, total := 0, len(snap.hashes); i < total && len(result) < n; i++ {
+		owner := snap.owners[idx]
+		if _, ok := seen[owner]; !ok {
+			seen[owner] = struct{}{}
+			result = append(result, owner)
+		}
+		idx++
+		if idx == len(snap.hashes) {
+			idx = 0
+		}
+	}
+	return result
+}
+
+// GetNext returns the node after current in key's replica order (the same
+// order GetN returns), wrapping around to the first node again after the
+// last. It returns "" if current is not a registered node or no other node
+// is registered, so a client that saw current fail can transparently retry
+// the successor.
+func (m *RingMap) GetNext(key, current string) string {
+	snap := m.ring.Load()
+	if len(snap.hashes) == 0 {
+		return ""
+	}
+	order := m.GetN(key, len(snap.hashes))
+	if len(order) < 2 {
+		return ""
+	}
+	for i, owner := range order {
+		if owner == current {
+			return order[(i+1)%len(order)]
+		}
+	}
+	return ""
+}
+
+// GetLoad is like Get, but skips nodes that are already serving their share
+// of in-flight requests (per NewBounded's loadFactor), walking the ring
+// forward until it finds one with spare capacity. Callers must pair every
+// successful GetLoad with a Done once the request finishes. It returns
+// ErrNoCapacity if every node is saturated.
+func (m *RingMap) GetLoad(key string) (string, error) {
+	snap := m.ring.Load()
+	if len(snap.hashes) == 0 {
+		return "", ErrNoCapacity
+	}
+	hash := m.config.Load().hash([]byte(key))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	idx := snap.floor(hash)
+	capacity := m.capacityLocked()
+	for i, total := 0, len(snap.hashes); i < total; i++ {
+		owner := snap.owners[idx]
+		if m.loads[owner] < capacity {
+			m.loads[owner]++
+			return owner, nil
+		}
+		idx++
+		if idx == len(snap.hashes) {
+			idx = 0
+		}
+	}
+	return "", ErrNoCapacity
+}
+
+// Done decrements node's in-flight count, freeing up capacity for GetLoad.
+func (m *RingMap) Done(node string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.loads[node] > 0 {
+		m.loads[node]--
+	}
+}
+
+// capacityLocked returns the maximum in-flight count any one node may carry
+// right now: ceil((T+1) * loadFactor / N), where T is the total in-flight
+// count across all nodes and N is the number of nodes. m.mu must be held.
+func (m *RingMap) capacityLocked() int64 {
+	n := int64(len(m.config.Load().keys))
+	if n == 0 {
+		return 0
+	}
+	var total int64
+	for _, c := range m.loads {
+		total += c
+	}
+	return int64(math.Ceil(float64(total+1) * m.loadFactor / float64(n)))
+}
+
+var (
+	hashRegistryMu sync.Mutex
+	hashRegistry   = map[string]Hash{}
+)
+
+func init() {
+	RegisterHash("crc32.ChecksumIEEE", crc32.ChecksumIEEE)
+}
+
+// RegisterHash associates name with fn, so that a RingMap built with fn can
+// be round-tripped through MarshalBinary/UnmarshalBinary (and their gob and
+// JSON equivalents). Call it once, typically from an init function, for
+// every Hash used with a RingMap that will be persisted.
+func RegisterHash(name string, fn Hash) {
+	hashRegistryMu.Lock()
+	defer hashRegistryMu.Unlock()
+	hashRegistry[name] = fn
+}
+
+func lookupHashName(fn Hash) (string, bool) {
+	hashRegistryMu.Lock()
+	defer hashRegistryMu.Unlock()
+	target := reflect.ValueOf(fn).Pointer()
+	for name, registered := range hashRegistry {
+		if reflect.ValueOf(registered).Pointer() == target {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func lookupHashByName(name string) (Hash, bool) {
+	hashRegistryMu.Lock()
+	defer hashRegistryMu.Unlock()
+	fn, ok := hashRegistry[name]
+	return fn, ok
+}
+
+// ringMapState is the serializable form of a RingMap: enough to rebuild an
+// identical ring without recomputing every virtual-node hash by hand, since
+// deriving it only requires the hash function, replica count and the
+// per-key weight (AddWeighted).
+type ringMapState struct {
+	Replicas int
+	HashName string
+	Weights  map[string]int
+}
+
+// state captures m's current configuration for serialization. It fails if m
+// was built with New64/NewSeeded64 (no registrable 32-bit Hash to record)
+// or with a Hash that was never passed to RegisterHash.
+func (m *RingMap) state() (ringMapState, error) {
+	cfg := m.config.Load()
+	if cfg.origHash == nil {
+		return ringMapState{}, errors.New("consistenthash: only a RingMap built with New can be marshaled")
+	}
+	name, ok := lookupHashName(cfg.origHash)
+	if !ok {
+		return ringMapState{}, errors.New("consistenthash: hash function was never passed to RegisterHash")
+	}
+	weights := make(map[string]int, len(cfg.keys))
+	for key, hashes := range cfg.keys {
+		weights[key] = len(hashes) / cfg.replicas
+	}
+	return ringMapState{Replicas: cfg.replicas, HashName: name, Weights: weights}, nil
+}
+
+// restore rebuilds m from state, replacing its current configuration
+// entirely. The new config and ring snapshot are each published with a
+// single atomic store, so concurrent Get/GetN/GetLoad callers never observe
+// a torn mix of old and new state. In-flight load counters from NewBounded
+// are not part of state and are left untouched.
+func (m *RingMap) restore(state ringMapState) error {
+	fn, ok := lookupHashByName(state.HashName)
+	if !ok {
+		return fmt.Errorf("consistenthash: unknown hash function %q; call RegisterHash before unmarshaling", state.HashName)
+	}
+	rebuilt := New(state.Replicas, fn)
+	rebuilt.AddWeightedMany(state.Weights)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config.Store(rebuilt.config.Load())
+	m.ring.Store(rebuilt.ring.Load())
+	return nil
+}
+
+// MarshalBinary encodes m's configuration (replica count, registered hash
+// name, and each member key with its weight) with gob, so a service can
+// persist its ring across restarts. The virtual-node hashes themselves are
+// not encoded: UnmarshalBinary recomputes all of them from this data.
+func (m *RingMap) MarshalBinary() ([]byte, error) {
+	state, err := m.state()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary restores m from data produced by MarshalBinary. It fails
+// if data names a hash function that was never passed to RegisterHash.
+func (m *RingMap) UnmarshalBinary(data []byte) error {
+	var state ringMapState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return err
+	}
+	return m.restore(state)
+}
+
+// MarshalJSON is the JSON equivalent of MarshalBinary.
+func (m *RingMap) MarshalJSON() ([]byte, error) {
+	state, err := m.state()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(state)
+}
+
+// UnmarshalJSON is the JSON equivalent of UnmarshalBinary.
+func (m *RingMap) UnmarshalJSON(data []byte) error {
+	var state ringMapState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	return m.restore(state)
+}
+
+// RendezvousMap implements Placement with Highest-Random-Weight (rendezvous)
+// hashing: the owner of a key is whichever registered node scores highest
+// for key||node. Unlike RingMap it needs no replicas parameter and gives
+// near-perfect balance, and moving a node only reshuffles roughly 1/N of
+// keys - a good trade for small clusters (<1000 nodes). The trade-off is an
+// O(N) lookup instead of RingMap's O(log N).
+type RendezvousMap struct {
+	hash func(data []byte) uint64
+
+	mu    sync.Mutex
+	nodes map[string]struct{}
+	order atomic.Pointer[[]string] // sorted node names, for lock-free Get/GetN
+}
+
+// NewRendezvous builds a Placement backed by rendezvous hashing instead of a
+// ring. If fn is nil, scores are computed with hash/maphash using a seed
+// generated for this RendezvousMap: a 32-bit hash like crc32.ChecksumIEEE
+// doesn't avalanche well enough scoring key||node pairs and produces a
+// visible load skew between nodes, the same clustering problem Hash has on
+// large rings (see New64).
+func NewRendezvous(fn Hash) *RendezvousMap {
+	var h func(data []byte) uint64
+	if fn == nil {
+		h = maphashSum64(maphash.MakeSeed())
+	} else {
+		h = func(data []byte) uint64 { return uint64(fn(data)) }
+	}
+	m := &RendezvousMap{
+		hash:  h,
+		nodes: make(map[string]struct{}),
+	}
+	empty := []string{}
+	m.order.Store(&empty)
+	return m
+}
+
+// Add registers some nodes.
+func (m *RendezvousMap) Add(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := false
+	for _, key := range keys {
+		if _, ok := m.nodes[key]; ok {
+			continue
+		}
+		m.nodes[key] = struct{}{}
+		changed = true
+	}
+	if changed {
+		m.rebuildLocked()
+	}
+}
+
+// Remove unregisters a node.
+func (m *RendezvousMap) Remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.nodes[key]; ok {
+		delete(m.nodes, key)
+		m.rebuildLocked()
+	}
+}
+
+// rebuildLocked recomputes the node-name snapshot and atomically swaps it
+// in. m.mu must be held.
+func (m *RendezvousMap) rebuildLocked() {
+	order := make([]string, 0, len(m.nodes))
+	for node := range m.nodes {
+		order = append(order, node)
+	}
+	sort.Strings(order)
+	m.order.Store(&order)
+}
+
+// score is the weight of node for key: higher wins.
+func (m *RendezvousMap) score(key, node string) uint64 {
+	return m.hash([]byte(key + "\x00" + node))
+}
+
+// Get returns the node that scores highest for key.
+func (m *RendezvousMap) Get(key string) string {
+	nodes := *m.order.Load()
+	if len(nodes) == 0 {
+		return ""
+	}
+	best, bestScore := nodes[0], m.score(key, nodes[0])
+	for _, node := range nodes[1:] {
+		if s := m.score(key, node); s > bestScore {
+			best, bestScore = node, s
+		}
+	}
+	return best
+}
+
+// GetN returns up to n nodes for key, ordered from highest to lowest score.
+func (m *RendezvousMap) GetN(key string, n int) []string {
+	nodes := *m.order.Load()
+	if len(nodes) == 0 || n <= 0 {
+		return nil
+	}
+	type scored struct {
+		node  string
+		score uint64
+	}
+	scores := make([]scored, len(nodes))
+	for i, node := range nodes {
+		scores[i] = scored{node: node, score: m.score(key, node)}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].score != scores[j].score {
+			return scores[i].score > scores[j].score
+		}
+		return scores[i].node < scores[j].node
+	})
+	if n > len(scores) {
+		n = len(scores)
+	}
+	result := make([]string, n)
+	for i := 0; i < n; i++ {
+		result[i] = scores[i].node
 	}
-	return iter.Node().Key.(*node).key
+	return result
 }